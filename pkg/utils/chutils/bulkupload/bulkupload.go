@@ -1,16 +1,24 @@
 package bulkupload
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"gopkg.in/djherbis/buffer.v1"
 	"gopkg.in/djherbis/nio.v2"
 
@@ -24,9 +32,336 @@ var (
 			return buffer.New(1 * 1024 * 1024)
 		}}
 
+	// gzipWriterPools are keyed per compression level, since a pooled
+	// *gzip.Writer can only be Reset() onto the level it was created with.
+	gzipWriterPools   = make(map[int]*sync.Pool)
+	gzipWriterPoolsMu sync.Mutex
+
 	client = &http.Client{}
 )
 
+// Compressor picks the codec BulkUpload uses to encode a batch before it is
+// POSTed to ClickHouse.
+type Compressor interface {
+	// NewWriter wraps w, returning a writer whose output w should receive.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// Encoding is the value for the Content-Encoding request header, or ""
+	// if the payload is sent uncompressed.
+	Encoding() string
+}
+
+// flusher is implemented by writers that can push buffered data downstream
+// without closing the stream, e.g. *gzip.Writer and *zstd.Encoder.
+type flusher interface {
+	Flush() error
+}
+
+// CompressionLevel is the gzip compression level to use for bulk uploads. In
+// addition to the named presets, any value accepted by gzip.NewWriterLevel
+// (gzip.HuffmanOnly..gzip.BestCompression) can be used.
+type CompressionLevel string
+
+const (
+	CompressionBestSpeed       CompressionLevel = "best-speed"
+	CompressionBestCompression CompressionLevel = "best-compression"
+	CompressionDefault         CompressionLevel = "default"
+)
+
+// gzipLevel resolves a CompressionLevel into the int gzip expects, defaulting
+// to gzip.BestSpeed for the empty value to preserve the previous behavior.
+func gzipLevel(level CompressionLevel) (int, error) {
+	switch level {
+	case "", CompressionBestSpeed:
+		return gzip.BestSpeed, nil
+	case CompressionBestCompression:
+		return gzip.BestCompression, nil
+	case CompressionDefault:
+		return gzip.DefaultCompression, nil
+	}
+
+	n, err := strconv.Atoi(string(level))
+	if err != nil {
+		return 0, fmt.Errorf("unknown compression level %q", level)
+	}
+
+	if err := validateGzipLevel(n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// validateGzipLevel rejects anything gzip.NewWriterLevel would itself
+// reject, so a bad level is caught here instead of gzip.NewWriterLevel
+// silently handing back a nil writer for getGzipWriterPool's pool to store.
+func validateGzipLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("gzip compression level %d out of range [%d, %d]", level, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+
+	return nil
+}
+
+// gzipCompressor is a Compressor that pools *gzip.Writer instances per
+// compression level, since spinning up a fresh flate writer for every short
+// bulk upload is wasteful.
+type gzipCompressor struct {
+	level int
+	pool  *sync.Pool
+}
+
+// NewGzipCompressor returns an error for any level gzip.NewWriterLevel would
+// reject, rather than letting that error be silently discarded later by the
+// pool and handing back a nil *gzip.Writer that panics on Reset.
+func NewGzipCompressor(level int) (*gzipCompressor, error) {
+	if err := validateGzipLevel(level); err != nil {
+		return nil, err
+	}
+
+	return &gzipCompressor{level: level, pool: getGzipWriterPool(level)}, nil
+}
+
+func getGzipWriterPool(level int) *sync.Pool {
+	gzipWriterPoolsMu.Lock()
+	defer gzipWriterPoolsMu.Unlock()
+
+	pool, ok := gzipWriterPools[level]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() interface{} {
+				// level is validated by NewGzipCompressor before this pool
+				// is ever created, so this should always succeed.
+				w, err := gzip.NewWriterLevel(ioutil.Discard, level)
+				if err != nil {
+					panic(fmt.Sprintf("bulkupload: unreachable: validated gzip level %d rejected: %v", level, err))
+				}
+
+				return w
+			},
+		}
+		gzipWriterPools[level] = pool
+	}
+
+	return pool
+}
+
+func (g *gzipCompressor) Encoding() string { return "gzip" }
+
+func (g *gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	gw := g.pool.Get().(*gzip.Writer)
+	gw.Reset(w)
+
+	return &pooledGzipWriter{Writer: gw, pool: g.pool}, nil
+}
+
+// pooledGzipWriter returns its *gzip.Writer to the owning pool once closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	p.pool.Put(p.Writer)
+
+	return err
+}
+
+// zstdCompressor is a Compressor backed by klauspost/compress/zstd, useful on
+// fast links where gzip's ratio isn't worth its CPU cost.
+type zstdCompressor struct{}
+
+func NewZstdCompressor() *zstdCompressor { return &zstdCompressor{} }
+
+func (z *zstdCompressor) Encoding() string { return "zstd" }
+
+func (z *zstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("could not create zstd writer: %v", err)
+	}
+
+	return enc, nil
+}
+
+// noneCompressor sends the payload as-is, for local/fast links where any
+// compression is pure CPU overhead.
+type noneCompressor struct{}
+
+func NewNoneCompressor() *noneCompressor { return &noneCompressor{} }
+
+func (n *noneCompressor) Encoding() string { return "" }
+
+func (n *noneCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CHError is returned by performRequest when ClickHouse answers with a
+// non-200 status. It carries the HTTP status and, where ClickHouse sent one,
+// the X-ClickHouse-Exception-Code so callers can react to specific codes
+// (e.g. sleep longer on TOO_MANY_PARTS, give up on CANNOT_PARSE_INPUT).
+type CHError struct {
+	Code   int
+	Status int
+	Body   string
+}
+
+func (e *CHError) Error() string {
+	return fmt.Sprintf("got %d status code from clickhouse (exception code %d): %s", e.Status, e.Code, e.Body)
+}
+
+// chExceptionTooManyParts is ClickHouse's TOO_MANY_PARTS exception code: the
+// table has too many unmerged parts and the insert should be retried after a
+// backoff rather than aborted.
+const chExceptionTooManyParts = 252
+
+// Retryable reports whether the batch is worth resending: either ClickHouse
+// is overloaded (5xx/429, or TOO_MANY_PARTS) rather than rejecting the data
+// itself (400/404, or any other user-facing exception).
+func (e *CHError) Retryable() bool {
+	if e.Code == chExceptionTooManyParts {
+		return true
+	}
+
+	return e.Status == http.StatusTooManyRequests || e.Status >= http.StatusInternalServerError
+}
+
+// RetryPolicy configures how BulkUpload retries a failed batch: exponential
+// backoff with jitter, capped at MaxAttempts tries in total.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used by New, NewWithCompression and NewWithCompressor
+// unless overridden via BulkUpload.SetRetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// backoff returns how long to sleep before retry attempt n (1-based),
+// applying full jitter in [0, delay) to avoid a thundering herd. A
+// RetryPolicy with no delay configured (MaxDelay <= 0) retries immediately.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// normalizeRetryPolicy clamps MaxAttempts to at least 1, so BulkUpload
+// always performs the request at least once even when handed the zero value
+// of RetryPolicy.
+func normalizeRetryPolicy(p RetryPolicy) RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+
+	return p
+}
+
+// isRetryable reports whether err is worth resending the batch for: a CHError
+// is checked against its code/status, anything else reaching here is a
+// transport-level failure (connection refused, timeout, ...) and is retried.
+func isRetryable(err error) bool {
+	var chErr *CHError
+	if errors.As(err, &chErr) {
+		return chErr.Retryable()
+	}
+
+	return true
+}
+
+// retryBuffer captures a BulkUpload's compressed payload so it can be resent
+// on retry, since the nio pipe it is produced from can only be read once. It
+// keeps up to threshold bytes in memory and spills to a temp file beyond
+// that, so large batches don't get buffered entirely in RAM.
+type retryBuffer struct {
+	threshold int
+	mem       *bytes.Buffer
+	file      *os.File
+}
+
+func newRetryBuffer(threshold int) *retryBuffer {
+	return &retryBuffer{threshold: threshold, mem: &bytes.Buffer{}}
+}
+
+func (b *retryBuffer) Write(p []byte) (int, error) {
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+
+	if b.mem.Len()+len(p) <= b.threshold {
+		return b.mem.Write(p)
+	}
+
+	f, err := ioutil.TempFile("", "pg2ch-bulkupload-")
+	if err != nil {
+		return 0, fmt.Errorf("could not create spool file: %v", err)
+	}
+	if _, err := f.Write(b.mem.Bytes()); err != nil {
+		return 0, err
+	}
+	b.mem = nil
+	b.file = f
+
+	return f.Write(p)
+}
+
+// Reader rewinds the buffer and returns a fresh reader over its contents, to
+// be called once per retry attempt.
+func (b *retryBuffer) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.mem.Bytes()), nil
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not rewind spool file: %v", err)
+	}
+
+	// The HTTP transport closes a request body that is an io.Closer, which
+	// would close the spool file after the first attempt; hide Close from it.
+	return ioutil.NopCloser(b.file), nil
+}
+
+func (b *retryBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+
+	name := b.file.Name()
+	if err := b.file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// Format selects how rows are serialized for the INSERT and which FORMAT
+// clause is appended to the query. TSV is the default and keeps using
+// chutils.GenInsertQuery's existing VALUES/TSV encoding; JSONEachRow and
+// Native are escape-free alternatives for schemas with Array/Map/Nested
+// columns.
+type Format string
+
+const (
+	FormatTSV         Format = "TSV"
+	FormatJSONEachRow Format = "JSONEachRow"
+	FormatNative      Format = "Native"
+)
+
 type BulkUploader interface {
 	Start() error
 	Finish() error
@@ -38,21 +373,107 @@ type BulkUpload struct {
 	baseURL      string
 	pipeWriter   *nio.PipeWriter
 	pipeReader   *nio.PipeReader
-	gzipWriter   *gzip.Writer
+	compressor   Compressor
+	writer       io.WriteCloser
 	buf          buffer.Buffer
 	tableName    string
 	columns      []string
 	gzipBufBytes int
 	gzipBufSize  int
+	retry        RetryPolicy
+	format       Format
+}
+
+// SetRetryPolicy overrides the retry behavior used by BulkUpload; the
+// default is DefaultRetryPolicy.
+func (c *BulkUpload) SetRetryPolicy(p RetryPolicy) {
+	c.retry = normalizeRetryPolicy(p)
+}
+
+// SetFormat overrides the insert format used by BulkUpload; the default is
+// FormatTSV.
+func (c *BulkUpload) SetFormat(f Format) {
+	c.format = f
 }
 
+// WriteRow marshals row to the configured format and writes it as one
+// record of the batch. Only FormatJSONEachRow is supported: TSV keeps using
+// Write with caller-encoded rows, and Native rows have no generic
+// map/struct representation, so callers write pre-encoded Native blocks via
+// Write directly.
+func (c *BulkUpload) WriteRow(row interface{}) error {
+	if c.format != FormatJSONEachRow {
+		return fmt.Errorf("WriteRow: format %q does not support marshaling rows, use Write", c.format)
+	}
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("could not marshal row to json: %v", err)
+	}
+	b = append(b, '\n')
+
+	return c.Write(b)
+}
+
+// New creates a BulkUpload that gzip-compresses data at CompressionBestSpeed
+// before sending it to ClickHouse. Use NewWithCompression or
+// NewWithCompressor to pick a different codec.
 func New(baseURL string, gzipBufSize int) *BulkUpload {
-	ch := &BulkUpload{
+	// gzip.BestSpeed is always a valid level, so this can never fail.
+	compressor, _ := NewGzipCompressor(gzip.BestSpeed)
+
+	return NewWithCompressor(baseURL, gzipBufSize, compressor)
+}
+
+// NewWithCompression is like New but lets the caller trade CPU for network
+// bandwidth by picking the gzip compression level used for bulk uploads.
+func NewWithCompression(baseURL string, gzipBufSize int, level CompressionLevel) (*BulkUpload, error) {
+	l, err := gzipLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := NewGzipCompressor(l)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithCompressor(baseURL, gzipBufSize, compressor), nil
+}
+
+// NewWithCompressor creates a BulkUpload using an arbitrary Compressor, e.g.
+// to send zstd-encoded or uncompressed payloads to ClickHouse.
+func NewWithCompressor(baseURL string, gzipBufSize int, compressor Compressor) *BulkUpload {
+	return &BulkUpload{
 		baseURL:     strings.TrimRight(baseURL, "/") + "/",
 		gzipBufSize: gzipBufSize,
+		compressor:  compressor,
+		retry:       normalizeRetryPolicy(DefaultRetryPolicy),
+		format:      FormatTSV,
+	}
+}
+
+// chTSVFormatClause is the trailing FORMAT clause chutils.GenInsertQuery
+// appends today.
+const chTSVFormatClause = "FORMAT TSV"
+
+// insertQuery builds the INSERT statement for tableName/columns in the
+// configured format. TSV uses chutils.GenInsertQuery as-is; other formats
+// swap its trailing "FORMAT TSV" clause until that helper grows a format
+// parameter of its own. Errors loudly instead of guessing if that clause
+// isn't there to swap.
+func (c *BulkUpload) insertQuery(tableName config.ChTableName, columns []string) (string, error) {
+	query := chutils.GenInsertQuery(tableName, columns)
+	if c.format == "" || c.format == FormatTSV {
+		return query, nil
+	}
+
+	if !strings.HasSuffix(query, chTSVFormatClause) {
+		return "", fmt.Errorf("chutils.GenInsertQuery did not end with %q, cannot switch to format %q: %q",
+			chTSVFormatClause, c.format, query)
 	}
 
-	return ch
+	return strings.TrimSuffix(query, chTSVFormatClause) + "FORMAT " + string(c.format), nil
 }
 
 func (c *BulkUpload) performRequest(query string, body io.Reader) error {
@@ -60,7 +481,9 @@ func (c *BulkUpload) performRequest(query string, body io.Reader) error {
 	if err != nil {
 		return fmt.Errorf("could not create request: %v", err)
 	}
-	req.Header.Add("Content-Encoding", "gzip")
+	if encoding := c.compressor.Encoding(); encoding != "" {
+		req.Header.Add("Content-Encoding", encoding)
+	}
 	req.Header.Set("User-Agent", config.ApplicationName)
 
 	resp, err := client.Do(req)
@@ -79,7 +502,9 @@ func (c *BulkUpload) performRequest(query string, body io.Reader) error {
 			return fmt.Errorf("could not read err body: %v", err)
 		}
 
-		return fmt.Errorf("got %d status code from clickhouse: %s", resp.StatusCode, string(body))
+		code, _ := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code"))
+
+		return &CHError{Code: code, Status: resp.StatusCode, Body: string(body)}
 	}
 
 	return nil
@@ -91,22 +516,53 @@ func (c *BulkUpload) BulkUpload(tableName config.ChTableName, columns []string)
 		bufPool.Put(c.buf)
 	}()
 
-	if err := c.performRequest(chutils.GenInsertQuery(tableName, columns), c.pipeReader); err != nil {
+	rb := newRetryBuffer(c.gzipBufSize)
+	defer func() {
+		if err := rb.Close(); err != nil {
+			log.Printf("could not clean up retry buffer: %v", err)
+		}
+	}()
+
+	if _, err := io.Copy(rb, c.pipeReader); err != nil {
+		return fmt.Errorf("could not buffer batch for retry: %v", err)
+	}
+
+	query, err := c.insertQuery(tableName, columns)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	for attempt := 1; attempt <= c.retry.MaxAttempts; attempt++ {
+		body, rerr := rb.Reader()
+		if rerr != nil {
+			return rerr
+		}
+
+		err = c.performRequest(query, body)
+		if err == nil {
+			return nil
+		}
+
+		if attempt == c.retry.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+
+		log.Printf("bulk upload attempt %d/%d failed, retrying: %v", attempt, c.retry.MaxAttempts, err)
+		time.Sleep(c.retry.backoff(attempt))
+	}
+
+	return err
 }
 
 func (c *BulkUpload) Start() error {
-	var err error
-
 	c.buf = bufPool.Get().(buffer.Buffer)
 	c.pipeReader, c.pipeWriter = nio.Pipe(c.buf)
-	c.gzipWriter, err = gzip.NewWriterLevel(c.pipeWriter, gzip.BestSpeed) // TODO: move gzip level to config
+
+	writer, err := c.compressor.NewWriter(c.pipeWriter)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not create compressor writer: %v", err)
 	}
+	c.writer = writer
 
 	return nil
 }
@@ -114,11 +570,13 @@ func (c *BulkUpload) Start() error {
 func (c *BulkUpload) Write(p []byte) error {
 	c.gzipBufBytes += len(p)
 
-	_, err := c.gzipWriter.Write(p)
+	_, err := c.writer.Write(p)
 
 	if c.gzipBufBytes >= c.gzipBufSize {
-		if err := c.gzipWriter.Flush(); err != nil {
-			return fmt.Errorf("could not flush gzip: %v", err)
+		if f, ok := c.writer.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				return fmt.Errorf("could not flush: %v", err)
+			}
 		}
 		c.gzipBufBytes = 0
 	}
@@ -127,7 +585,7 @@ func (c *BulkUpload) Write(p []byte) error {
 }
 
 func (c *BulkUpload) Finish() error {
-	if err := c.gzipWriter.Close(); err != nil {
+	if err := c.writer.Close(); err != nil {
 		return err
 	}
 
@@ -0,0 +1,102 @@
+package bulkupload
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoffZeroDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, BaseDelay: 0, MaxDelay: 0}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if d := p.backoff(attempt); d != 0 {
+			t.Fatalf("backoff(%d) = %v, want 0", attempt, d)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffBounded(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		if d := p.backoff(attempt); d < 0 || d > p.MaxDelay {
+			t.Fatalf("backoff(%d) = %v, want in [0, %v]", attempt, d, p.MaxDelay)
+		}
+	}
+}
+
+func TestNormalizeRetryPolicyClampsMaxAttempts(t *testing.T) {
+	got := normalizeRetryPolicy(RetryPolicy{})
+	if got.MaxAttempts != 1 {
+		t.Fatalf("MaxAttempts = %d, want 1", got.MaxAttempts)
+	}
+
+	got = normalizeRetryPolicy(RetryPolicy{MaxAttempts: 7})
+	if got.MaxAttempts != 7 {
+		t.Fatalf("MaxAttempts = %d, want 7", got.MaxAttempts)
+	}
+}
+
+func TestNewWithCompressionRejectsOutOfRangeLevel(t *testing.T) {
+	if _, err := NewWithCompression("http://localhost", 1024, CompressionLevel("42")); err == nil {
+		t.Fatal("NewWithCompression: want an error for an out-of-range gzip level, got nil")
+	}
+}
+
+func TestNewGzipCompressorRejectsOutOfRangeLevel(t *testing.T) {
+	if _, err := NewGzipCompressor(42); err == nil {
+		t.Fatal("NewGzipCompressor: want an error for an out-of-range level, got nil")
+	}
+}
+
+func TestRetryBufferInMemory(t *testing.T) {
+	rb := newRetryBuffer(1024)
+	defer rb.Close()
+
+	want := []byte("hello clickhouse")
+	if _, err := rb.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatalf("Reader: %v", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("attempt %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestRetryBufferSpillsToFile(t *testing.T) {
+	rb := newRetryBuffer(4)
+	defer rb.Close()
+
+	want := []byte("this payload is longer than the threshold")
+	if _, err := rb.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if rb.file == nil {
+		t.Fatal("expected retryBuffer to spill to a file once over threshold")
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := rb.Reader()
+		if err != nil {
+			t.Fatalf("Reader: %v", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("attempt %d: got %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package bulkupload
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+)
+
+// FlushErrors aggregates the failures of the batches a Flush waited on.
+type FlushErrors []error
+
+func (e FlushErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d batch(es) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ParallelBulkUploader overlaps encoding the next batch with sending the
+// previous one: while a worker POSTs a finished BulkUpload to ClickHouse,
+// rows for the next batch are already being written and gzipped. This
+// roughly doubles throughput on high-latency links compared to the serial
+// Start/Write/Finish/BulkUpload sequence.
+type ParallelBulkUploader struct {
+	newUpload   func() *BulkUpload
+	tableName   config.ChTableName
+	columns     []string
+	maxInflight int
+	batchBytes  int
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu   sync.Mutex
+	errs FlushErrors
+
+	cur      *BulkUpload
+	curBytes int
+}
+
+// NewParallelBulkUploader creates a ParallelBulkUploader for tableName/columns.
+// newUpload builds a fresh *BulkUpload for each batch (baseURL, compressor and
+// retry policy are up to the caller's factory). maxInflight bounds how many
+// BulkUpload.BulkUpload calls may run concurrently and is clamped to at least
+// 1 (a misconfigured 0 would otherwise make dispatch() block forever, since
+// the channel send happens before its only receiver is spawned). batchBytes
+// is the uncompressed row size at which a batch is closed off and dispatched.
+func NewParallelBulkUploader(newUpload func() *BulkUpload, tableName config.ChTableName, columns []string, maxInflight, batchBytes int) *ParallelBulkUploader {
+	if maxInflight < 1 {
+		maxInflight = 1
+	}
+
+	return &ParallelBulkUploader{
+		newUpload:   newUpload,
+		tableName:   tableName,
+		columns:     columns,
+		maxInflight: maxInflight,
+		batchBytes:  batchBytes,
+		sem:         make(chan struct{}, maxInflight),
+	}
+}
+
+func (p *ParallelBulkUploader) ensureStarted() error {
+	if p.cur != nil {
+		return nil
+	}
+
+	up := p.newUpload()
+	if err := up.Start(); err != nil {
+		return err
+	}
+	p.cur = up
+	p.curBytes = 0
+
+	return nil
+}
+
+// Write encodes a row into the current batch, dispatching it to a worker as
+// soon as it reaches batchBytes.
+func (p *ParallelBulkUploader) Write(row []byte) error {
+	if err := p.ensureStarted(); err != nil {
+		return err
+	}
+
+	if err := p.cur.Write(row); err != nil {
+		return err
+	}
+	p.curBytes += len(row)
+
+	if p.curBytes >= p.batchBytes {
+		return p.dispatch()
+	}
+
+	return nil
+}
+
+// dispatch closes off the current batch and hands it to a worker, blocking
+// only if maxInflight uploads are already in flight.
+func (p *ParallelBulkUploader) dispatch() error {
+	batch := p.cur
+	p.cur = nil
+	p.curBytes = 0
+
+	if err := batch.Finish(); err != nil {
+		return err
+	}
+
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+
+		if err := batch.BulkUpload(p.tableName, p.columns); err != nil {
+			p.mu.Lock()
+			p.errs = append(p.errs, err)
+			p.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// Flush dispatches any partial batch and waits for every in-flight upload to
+// drain, returning the aggregated FlushErrors if any batch failed, or ctx's
+// error if it is cancelled first. It always waits on already-dispatched
+// batches before returning, even if closing off the trailing partial batch
+// itself fails, so the caller never proceeds (e.g. to shut down) while
+// uploads are still outstanding.
+func (p *ParallelBulkUploader) Flush(ctx context.Context) error {
+	var dispatchErr error
+	if p.cur != nil {
+		dispatchErr = p.dispatch()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if dispatchErr != nil {
+		p.errs = append(p.errs, dispatchErr)
+	}
+
+	if len(p.errs) == 0 {
+		return nil
+	}
+
+	errs := p.errs
+	p.errs = nil
+
+	return errs
+}
@@ -0,0 +1,145 @@
+package bulkupload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+)
+
+// failCloseCompressor always fails on Close, to simulate BulkUpload.Finish
+// failing for the trailing partial batch in Flush.
+type failCloseCompressor struct{}
+
+func (failCloseCompressor) Encoding() string { return "" }
+
+func (failCloseCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return failCloseWriter{w}, nil
+}
+
+type failCloseWriter struct{ io.Writer }
+
+func (failCloseWriter) Close() error { return errors.New("forced close failure") }
+
+func TestNewParallelBulkUploaderClampsMaxInflight(t *testing.T) {
+	p := NewParallelBulkUploader(func() *BulkUpload { return nil }, config.ChTableName{}, nil, 0, 1024)
+
+	if cap(p.sem) != 1 {
+		t.Fatalf("sem capacity = %d, want 1 for a misconfigured maxInflight=0", cap(p.sem))
+	}
+}
+
+func newTestUploaderFactory(baseURL string) func() *BulkUpload {
+	return func() *BulkUpload {
+		up := New(baseURL, 64)
+		up.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+
+		return up
+	}
+}
+
+func TestParallelBulkUploaderFlushSuccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	p := NewParallelBulkUploader(newTestUploaderFactory(srv.URL), config.ChTableName{}, []string{"col"}, 2, 8)
+
+	for i := 0; i < 5; i++ {
+		if err := p.Write([]byte("row\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func TestParallelBulkUploaderFlushAggregatesErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	p := NewParallelBulkUploader(newTestUploaderFactory(srv.URL), config.ChTableName{}, []string{"col"}, 2, 8)
+
+	for i := 0; i < 5; i++ {
+		if err := p.Write([]byte("row\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := p.Flush(ctx)
+	if err == nil {
+		t.Fatal("Flush: want an aggregated error, got nil")
+	}
+	if _, ok := err.(FlushErrors); !ok {
+		t.Fatalf("Flush error type = %T, want FlushErrors", err)
+	}
+}
+
+// TestParallelBulkUploaderFlushWaitsForInflightOnDispatchError reproduces the
+// bug where Flush returned immediately when closing off the trailing partial
+// batch failed, without waiting for an earlier batch still in flight.
+func TestParallelBulkUploaderFlushWaitsForInflightOnDispatchError(t *testing.T) {
+	const uploadDelay = 200 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(uploadDelay)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var calls int32
+	factory := func() *BulkUpload {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// first batch: a normal uploader that hits the slow server.
+			return newTestUploaderFactory(srv.URL)()
+		}
+
+		// trailing batch: Finish() will fail when Flush dispatches it.
+		up := NewWithCompressor(srv.URL, 64, failCloseCompressor{})
+		up.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+
+		return up
+	}
+
+	p := NewParallelBulkUploader(factory, config.ChTableName{}, []string{"col"}, 2, 8)
+
+	// First batch reaches batchBytes and is dispatched to the slow server.
+	if err := p.Write([]byte("rowrowrow\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Second, trailing batch stays partial until Flush dispatches it.
+	if err := p.Write([]byte("row\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := p.Flush(ctx)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("Flush: want an error (forced Finish failure), got nil")
+	}
+	if elapsed < uploadDelay/2 {
+		t.Fatalf("Flush returned after %v, want it to have waited for the in-flight upload (~%v)", elapsed, uploadDelay)
+	}
+}